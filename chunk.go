@@ -0,0 +1,352 @@
+package grab
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// errRangeUnsupported is returned internally by fetchChunkOnce when the
+// remote server doesn't honour a ranged request the way a parallel download
+// needs it to. OpenWith treats it as a signal to fall back to a single
+// stream rather than surfacing it to the caller.
+var errRangeUnsupported = errors.New("server does not support partial content requests")
+
+// minChunkSize is the smallest chunk a Scheduler should ever produce; below
+// this the overhead of an extra connection isn't worth it.
+const minChunkSize int64 = 1 << 20 // 1MiB
+
+// ChunkRange is an inclusive byte range of a resource, as used in the HTTP
+// Range header (bytes=Start-End).
+type ChunkRange struct {
+	Start int64
+	End   int64
+}
+
+// Len returns the number of bytes covered by the range.
+func (c ChunkRange) Len() int64 {
+	return c.End - c.Start + 1
+}
+
+// Scheduler splits a resource of a known total size into the byte ranges
+// that a parallel download should fetch concurrently. grab only calls
+// Schedule once, at the start of the download, so the plan it returns is
+// fixed for the rest of the download; it is not revised when a chunk turns
+// out to be slow.
+type Scheduler interface {
+	Schedule(total int64) []ChunkRange
+}
+
+// fixedScheduler splits a resource into n equally sized chunks, shrinking n
+// when the resource is too small for every chunk to meet minChunkSize.
+type fixedScheduler struct {
+	n int
+}
+
+// NewFixedScheduler returns a Scheduler that splits a resource into n
+// roughly equal chunks.
+func NewFixedScheduler(n int) Scheduler {
+	return &fixedScheduler{n: n}
+}
+
+func (f *fixedScheduler) Schedule(total int64) []ChunkRange {
+	n := f.n
+	if n < 1 {
+		n = 1
+	}
+	if max := int(total / minChunkSize); max < n {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	size := total / int64(n)
+	ranges := make([]ChunkRange, n)
+	start := int64(0)
+	for i := 0; i < n; i++ {
+		end := start + size - 1
+		if i == n-1 {
+			end = total - 1
+		}
+		ranges[i] = ChunkRange{Start: start, End: end}
+		start = end + 1
+	}
+	return ranges
+}
+
+// ChunkState reports the progress of a single chunk of a parallel download.
+type ChunkState struct {
+	Range    ChunkRange
+	Attempts int
+	Done     bool
+	Err      error
+}
+
+// Chunks returns a snapshot of the state of every chunk of a parallel
+// download, in range order. It returns nil for downloads opened without
+// WithChunks, or with WithChunks(1).
+func (b *Body) Chunks() []ChunkState {
+	if !b.parallel {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]ChunkState, len(b.chunkStates))
+	for i, s := range b.chunkStates {
+		out[i] = *s
+	}
+	return out
+}
+
+// newParallelBody validates that req's resource can be fetched in ranges and,
+// if so, starts fetching every chunk but the first concurrently. It returns
+// errRangeUnsupported if the server didn't honour the validating request,
+// in which case OpenWith should fall back to a single stream.
+func newParallelBody(req *http.Request, o *options, total int64, etag *string, digester Digester, verifierName string, ranges []ChunkRange) (*Body, error) {
+	tmp, err := ioutil.TempFile("", "grab-*.part")
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Truncate(total); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	md5sum := md5.New()
+	digestWriter := io.Writer(md5sum)
+	if digester != nil {
+		digestWriter = io.MultiWriter(md5sum, digester)
+	}
+
+	// chunkCtx is what every chunk request is actually made with, instead of
+	// req.Context() directly, so that Close can always unblock an in-flight
+	// chunk fetch even when the caller's own context (e.g.
+	// context.Background() for Open/OpenWith) is never cancelled.
+	chunkCtx, chunkCancel := context.WithCancel(req.Context())
+
+	b := &Body{
+		ETag:          etag,
+		md5:           md5sum,
+		digester:      digester,
+		digestWriter:  digestWriter,
+		verifierName:  verifierName,
+		c:             o.c,
+		n:             o.n,
+		req:           req,
+		tPos:          total,
+		ctx:           req.Context(),
+		parallel:      true,
+		tmpFile:       tmp,
+		chunkPlan:     ranges,
+		closeCh:       make(chan struct{}),
+		chunkCtx:      chunkCtx,
+		chunkCancel:   chunkCancel,
+		rateLimiter:   o.rateLimiter,
+		progress:      o.progress,
+		progressEvery: o.progressEvery,
+	}
+	b.chunkStates = make([]*ChunkState, len(ranges))
+	for i := range ranges {
+		b.chunkStates[i] = &ChunkState{Range: ranges[i]}
+	}
+	b.cond = sync.NewCond(&b.mu)
+
+	if err := b.fetchChunkOnce(ranges[0]); err != nil {
+		Log.Printf("parallel: validating range request failed, falling back to single stream: %s", err)
+		chunkCancel()
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, errRangeUnsupported
+	}
+
+	b.mu.Lock()
+	b.chunkStates[0].Attempts = 1
+	b.chunkStates[0].Done = true
+	b.advanceFrontierLocked()
+	b.mu.Unlock()
+
+	// Wake any blocked Read, and abort every in-flight chunk request, as
+	// soon as the context is cancelled or the Body is closed, instead of
+	// leaving Close to wait on a chunk that will never arrive.
+	go func() {
+		select {
+		case <-b.ctx.Done():
+			b.mu.Lock()
+			if b.errOnce == nil {
+				b.errOnce = b.ctx.Err()
+			}
+			b.mu.Unlock()
+			b.cond.Broadcast()
+		case <-b.closeCh:
+		}
+		chunkCancel()
+	}()
+
+	b.wg.Add(len(ranges) - 1)
+	for i := 1; i < len(ranges); i++ {
+		go b.fetchChunk(i)
+	}
+	return b, nil
+}
+
+// fetchChunk fetches the i'th chunk of b's plan, retrying the whole chunk up
+// to b.n times before giving up and recording the failure on b.errOnce.
+func (b *Body) fetchChunk(i int) {
+	defer b.wg.Done()
+	rng := b.chunkPlan[i]
+	state := b.chunkStates[i]
+
+	var lastErr error
+	for attempt := 0; attempt < b.n; attempt++ {
+		b.mu.Lock()
+		state.Attempts++
+		b.mu.Unlock()
+		if err := b.fetchChunkOnce(rng); err != nil {
+			lastErr = err
+			if err == errRangeUnsupported {
+				break
+			}
+			// b.chunkCtx is what fetchChunkOnce actually requests with, and
+			// it's cancelled as soon as Close is called (see newParallelBody);
+			// retrying against it with a backoff would just make Close wait
+			// out the backoff instead of returning promptly.
+			if ctxErr := b.chunkCtx.Err(); ctxErr != nil {
+				lastErr = ctxErr
+				break
+			}
+			Log.Printf("chunk %d attempt %d: %s", i, attempt, err)
+			if serr := sleep(b.chunkCtx, attempt+1); serr != nil {
+				lastErr = serr
+				break
+			}
+			continue
+		}
+		lastErr = nil
+		break
+	}
+
+	b.mu.Lock()
+	if lastErr != nil {
+		state.Err = lastErr
+		if b.errOnce == nil {
+			b.errOnce = lastErr
+		}
+	} else {
+		state.Done = true
+		b.advanceFrontierLocked()
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// fetchChunkOnce issues a single ranged request for rng and copies the
+// response straight into b.tmpFile at the matching offset. It uses
+// b.chunkCtx rather than b.req.Context() directly so Close can always
+// abort it, even for downloads opened without a caller-supplied context.
+//
+// b.rateLimiter, if set, is consulted here rather than in readParallel,
+// since this is where bytes actually come off the wire for a parallel
+// download; readParallel only calls recordRead, to avoid waiting on the
+// limiter twice for the same bytes.
+func (b *Body) fetchChunkOnce(rng ChunkRange) error {
+	req := b.req.Clone(b.chunkCtx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rng.Start, rng.End))
+
+	resp, err := b.c.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		// A successful response that isn't 206 means the server ignored the
+		// Range header and sent the whole entity back, which is the one case
+		// that actually means range requests aren't supported here. Anything
+		// >= 300 is an ordinary request failure (a transient 5xx, a 429, an
+		// S3 error body, ...) and must fall through to fetchChunk's normal
+		// retry-with-backoff path instead of being treated as unrecoverable.
+		if resp.StatusCode < 300 {
+			resp.Body.Close()
+			return errRangeUnsupported
+		}
+		return checkResponse(resp)
+	}
+	defer resp.Body.Close()
+
+	offset := rng.Start
+	buf := make([]byte, 32*1024)
+	for {
+		nr, rerr := resp.Body.Read(buf)
+		if nr > 0 {
+			if _, werr := b.tmpFile.WriteAt(buf[:nr], offset); werr != nil {
+				return werr
+			}
+			offset += int64(nr)
+			if lerr := b.waitRateLimit(b.chunkCtx, nr); lerr != nil {
+				return lerr
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// advanceFrontierLocked extends b.frontier over every chunk, in range order,
+// that has finished downloading. b.mu must be held.
+func (b *Body) advanceFrontierLocked() {
+	for b.frontierIdx < len(b.chunkStates) && b.chunkStates[b.frontierIdx].Done {
+		b.frontier = b.chunkPlan[b.frontierIdx].End + 1
+		b.frontierIdx++
+	}
+}
+
+// readParallel implements Read for a parallel download, blocking until
+// enough contiguous chunks have landed in b.tmpFile to satisfy the read at
+// the current position. Bytes are fed through b.md5 in position order so
+// VerifyCopiedData still checks a digest of the reassembled stream.
+func (b *Body) readParallel(p []byte) (int, error) {
+	if b.cPos >= b.tPos {
+		return 0, io.EOF
+	}
+
+	b.mu.Lock()
+	for b.frontier <= b.cPos && b.errOnce == nil {
+		b.cond.Wait()
+	}
+	if b.frontier <= b.cPos {
+		err := b.errOnce
+		b.mu.Unlock()
+		return 0, err
+	}
+	avail := b.frontier - b.cPos
+	b.mu.Unlock()
+
+	toRead := int64(len(p))
+	if avail < toRead {
+		toRead = avail
+	}
+	n, err := b.tmpFile.ReadAt(p[:toRead], b.cPos)
+	if n > 0 {
+		b.digestWriter.Write(p[:n])
+		b.cPos += int64(n)
+		// Bytes were already rate limited in fetchChunkOnce when they came
+		// off the wire; only record them here, don't wait on the limiter a
+		// second time for the same bytes.
+		b.recordRead(n)
+	}
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
@@ -2,6 +2,7 @@ package grab
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"github.com/pkg/errors"
@@ -13,8 +14,17 @@ import (
 
 const backoff time.Duration = 600
 
-func sleep(i int) {
-	time.Sleep(time.Duration(math.Exp2(float64(i))) * backoff * time.Millisecond)
+// sleep waits out the backoff for retry attempt i, returning early with
+// ctx.Err() if ctx is done first.
+func sleep(ctx context.Context, i int) error {
+	t := time.NewTimer(time.Duration(math.Exp2(float64(i))) * backoff * time.Millisecond)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
 
 func checkResponse(r *http.Response) error {
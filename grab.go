@@ -2,6 +2,7 @@
 package grab
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"hash"
@@ -9,6 +10,8 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"sync"
 	"syscall"
 	"time"
 
@@ -46,51 +49,61 @@ func retry(req *http.Request, c *http.Client, n int, rng *int64) (resp *http.Res
 		if err == nil {
 			return
 		}
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			err = ctxErr
+			return
+		}
 		Log.Printf("http attempt %d: %s\n", i, err)
-		sleep(i + 1)
+		if err = sleep(req.Context(), i+1); err != nil {
+			return
+		}
 	}
 	err = errors.Wrapf(err, "request failed after %d attempts", n)
 	return
 }
 
-func tryParseETag(resp *http.Response) *string {
-	header := resp.Header.Get("Etag")
-	if header == "" {
-		return nil
-	}
-	// Expect exactly 32 bytes for an MD5 digest
-	// Only files uploaded as one block without multi-part upload are supported.
-	if len(header) != 32 {
-		return nil
-	}
-
-	return &header
-}
-
 // Open begins downloading the given URL.
 func Open(u string) (*Body, error) {
-	return OpenWith(u, DefaultAttempts, DefaultClient, nil)
+	return OpenWith(u)
 }
 
 // OpenWith begins downloading the given URL with custom options.
-func OpenWith(u string, n int, c *http.Client, h http.Header) (*Body, error) {
-	if c == nil {
-		c = DefaultClient
-	}
-	if n == 0 {
-		n = DefaultAttempts
-	}
-	req, err := http.NewRequest(http.MethodGet, u, nil)
+//
+// By default the download is a single stream retried up to DefaultAttempts
+// times; pass WithChunks(n) with n > 1 to fetch the resource as n concurrent
+// ranged requests instead. Parallel downloads are only attempted when the
+// server's initial response reports Accept-Ranges: bytes and a
+// Content-Length; OpenWith otherwise silently falls back to a single stream.
+func OpenWith(u string, opts ...Option) (*Body, error) {
+	return OpenWithContext(context.Background(), u, opts...)
+}
+
+// OpenContext begins downloading the given URL, aborting the download as
+// soon as ctx is done.
+func OpenContext(ctx context.Context, u string) (*Body, error) {
+	return OpenWithContext(ctx, u)
+}
+
+// OpenWithContext is OpenWith with an added context. Cancelling ctx aborts
+// the retry loop, any in-progress request, and (for parallel downloads) the
+// outstanding chunk fetches; it also unblocks any call to Body.Read waiting
+// on data that hasn't arrived yet, and later calls to Body.Read and
+// Body.Seek return ctx.Err().
+func OpenWithContext(ctx context.Context, u string, opts ...Option) (*Body, error) {
+	o := defaultOptions()
+	o.apply(opts)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return nil, err
 	}
 	// Copy global headers from client
-	if h != nil {
-		for k, v := range h {
+	if o.header != nil {
+		for k, v := range o.header {
 			req.Header[k] = v
 		}
 	}
-	resp, err := retry(req, c, n, nil)
+	resp, err := retry(req, o.c, o.n, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -101,18 +114,61 @@ func OpenWith(u string, n int, c *http.Client, h http.Header) (*Body, error) {
 		req.URL = resp.Request.URL
 	}
 
+	etag := parseETag(resp)
+	verifiers := o.verifiers
+	if verifiers == nil {
+		verifiers = DefaultVerifiers
+	}
+	digester, verifierName := detectVerifier(resp, req, o.c, verifiers)
+
+	if o.chunks > 1 && resp.ContentLength > 0 && resp.Header.Get("Accept-Ranges") == "bytes" {
+		scheduler := o.scheduler
+		if scheduler == nil {
+			scheduler = NewFixedScheduler(o.chunks)
+		}
+		if ranges := scheduler.Schedule(resp.ContentLength); len(ranges) > 1 {
+			resp.Body.Close()
+			body, err := newParallelBody(req, o, resp.ContentLength, etag, digester, verifierName, ranges)
+			if err == nil {
+				return body, nil
+			}
+			if err != errRangeUnsupported {
+				return nil, err
+			}
+			// The server didn't honour the validating ranged request;
+			// fall back to a plain single stream below.
+			resp, err = retry(req, o.c, o.n, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	md5sum := md5.New()
-	tee := io.TeeReader(resp.Body, md5sum)
+	digestWriter := io.Writer(md5sum)
+	if digester != nil {
+		digestWriter = io.MultiWriter(md5sum, digester)
+	}
+	tee := io.TeeReader(resp.Body, digestWriter)
 
 	return &Body{
-		ETag: tryParseETag(resp),
-		md5:  md5sum,
-		tee:  tee,
-		c:    c,
-		body: resp.Body,
-		tPos: resp.ContentLength,
-		req:  req,
-		n:    n,
+		ETag:          etag,
+		md5:           md5sum,
+		digester:      digester,
+		digestWriter:  digestWriter,
+		verifierName:  verifierName,
+		tee:           tee,
+		c:             o.c,
+		body:          resp.Body,
+		tPos:          resp.ContentLength,
+		req:           req,
+		n:             o.n,
+		ctx:           ctx,
+		origURL:       u,
+		lastModified:  resp.Header.Get("Last-Modified"),
+		rateLimiter:   o.rateLimiter,
+		progress:      o.progress,
+		progressEvery: o.progressEvery,
 	}, nil
 }
 
@@ -131,12 +187,61 @@ type Body struct {
 	md5  hash.Hash
 	tee  io.Reader
 
+	// digester and verifierName are set when a Verifier from
+	// DefaultVerifiers (or WithVerifiers) matched the response headers.
+	// digestWriter is always set: it feeds md5, plus digester when one
+	// matched, so Sum() keeps returning a plain MD5 of the copied bytes
+	// regardless of which Verifier matched.
+	digester     Digester
+	digestWriter io.Writer
+	verifierName string
+
+	// origURL and lastModified are recorded for SaveState; see state.go.
+	origURL      string
+	lastModified string
+
 	cPos int64
 	tPos int64
 
 	closed bool
 	seeked bool
 	err    error
+
+	// ctx aborts the download early; it defaults to context.Background()
+	// when the caller used Open/OpenWith instead of a *Context variant.
+	ctx context.Context
+
+	// rateLimiter, progress and the fields below them back WithRateLimiter,
+	// WithProgress, BytesRead and Rate; see progress.go.
+	rateLimiter     RateLimiter
+	progress        func(read, total int64, err error)
+	progressEvery   time.Duration
+	progressAt      time.Time
+	bytesRead       int64
+	rateMu          sync.Mutex
+	rate            float64
+	rateSampledAt   time.Time
+	rateSampleBytes int64
+
+	// parallel and the fields below it are only populated for downloads
+	// started with WithChunks(n) for n > 1; see chunk.go.
+	parallel    bool
+	tmpFile     *os.File
+	chunkPlan   []ChunkRange
+	chunkStates []*ChunkState
+	frontier    int64
+	frontierIdx int
+	errOnce     error
+	mu          sync.Mutex
+	cond        *sync.Cond
+	wg          sync.WaitGroup
+	closeCh     chan struct{}
+
+	// chunkCtx is derived from req.Context() but also cancelled when
+	// closeCh fires, so Close always aborts in-flight chunk requests
+	// promptly instead of waiting on a stalled response body.
+	chunkCtx    context.Context
+	chunkCancel context.CancelFunc
 }
 
 // Len returns the total length in bytes of the content.
@@ -144,12 +249,21 @@ func (b *Body) Len() int64 {
 	return b.tPos
 }
 
-// Close closes the currently opened body.
+// Close closes the currently opened body. For a parallel download this
+// blocks until every in-flight chunk has finished before removing the
+// backing temp file.
 func (b *Body) Close() error {
 	if b.closed {
 		return syscall.EINVAL
 	}
 	b.closed = true
+	if b.parallel {
+		close(b.closeCh)
+		b.wg.Wait()
+		err := b.tmpFile.Close()
+		os.Remove(b.tmpFile.Name())
+		return err
+	}
 	if b.body != nil {
 		return b.body.Close()
 	}
@@ -162,24 +276,26 @@ func (b *Body) Sum() []byte {
 	return b.md5.Sum(nil)
 }
 
-// VerifyCopiedData checks the copied data and returns an error
-// if the body ETag is set and the MD5 digest doesn't match the contents of the ETag header.
-// Checking the ETag value is not supported for seeked reading (the file must be consumed only once in its entirety)
-// Unless the body has been seeked to 0 and fully consumed, in which case the md5 hash is reset on call to Seek.
-//
-// Checking the value of the ETag is only supported if the file was not uploaded using a multi-part upload.
+// VerifyCopiedData checks the copied data against whichever Verifier
+// matched the response headers when the download began (see
+// DefaultVerifiers and WithVerifiers), returning an error if the digest it
+// computed doesn't match. It is a no-op if no Verifier matched.
+// Checking is not supported for seeked reading (the file must be consumed only once in its entirety)
+// unless the body has been seeked to 0 and fully consumed, in which case the digest is reset on call to Seek.
 func (b *Body) VerifyCopiedData() error {
-	if b.ETag == nil {
+	if b.digester == nil {
 		return nil
 	}
 	if b.seeked {
 		return errors.New("Cannot verify transfer for files that have been seeked")
 	}
-	digest := fmt.Sprintf("%x", b.Sum())
-	if *b.ETag != digest {
-		return errors.Errorf("ETag: Server reported ETag of %q but we calculated a digest of %q", *b.ETag, digest)
-	}
-	return nil
+	return b.digester.Verify()
+}
+
+// VerifierName returns the Name of the Verifier that matched the response
+// headers, or "" if none did (in which case VerifyCopiedData is a no-op).
+func (b *Body) VerifierName() string {
+	return b.verifierName
 }
 
 func (b *Body) nextReader() error {
@@ -201,7 +317,7 @@ func (b *Body) nextReader() error {
 	}
 
 	// Setup the new TeeReader to read from this response body instead
-	b.tee = io.TeeReader(resp.Body, b.md5)
+	b.tee = io.TeeReader(resp.Body, b.digestWriter)
 	b.body = resp.Body
 	return nil
 }
@@ -219,6 +335,11 @@ func (b *Body) read(p []byte) (n int, err error) {
 		rn, err = b.tee.Read(p[n:])
 		n += rn
 		b.cPos += int64(rn)
+		if rn > 0 {
+			if terr := b.trackRead(rn); terr != nil {
+				return n, terr
+			}
+		}
 
 		// A non EOF error occurred but we have enough data anyway
 		if err != io.EOF && b.cPos == b.tPos {
@@ -228,7 +349,10 @@ func (b *Body) read(p []byte) (n int, err error) {
 			return
 		}
 		Log.Printf("read attempt %d: %s", i, err)
-		sleep(i + 1)
+		if serr := sleep(b.ctx, i+1); serr != nil {
+			err = serr
+			return
+		}
 		b.body.Close()
 		b.body = nil
 
@@ -247,6 +371,20 @@ func (b *Body) Read(p []byte) (int, error) {
 	if b.err != nil {
 		return 0, b.err
 	}
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if b.parallel {
+		n, err := b.readParallel(p)
+		if err != nil && err != io.EOF {
+			b.err = err
+			b.reportProgress(err, true)
+		} else if err == io.EOF {
+			b.reportProgress(nil, true)
+		}
+		return n, err
+	}
 
 	if b.cPos == b.tPos+1 {
 		return 0, io.EOF
@@ -269,15 +407,18 @@ func (b *Body) Read(p []byte) (int, error) {
 		if err == io.EOF {
 			b.body = nil
 			if b.cPos == b.tPos {
+				b.reportProgress(nil, true)
 				return nw, io.EOF
 			}
 			if err := b.nextReader(); err != nil {
+				b.reportProgress(err, true)
 				return nw, err
 			}
 			continue
 		}
 		if err != nil {
 			b.err = err
+			b.reportProgress(err, true)
 			return nw, err
 		}
 	}
@@ -289,6 +430,10 @@ func (b *Body) Read(p []byte) (int, error) {
 // A new request is made for the new position on the next read call.
 // If the new seek position is 0 the md5 hash of the file is reset.
 func (b *Body) Seek(offset int64, whence int) (int64, error) {
+	if err := b.ctx.Err(); err != nil {
+		return b.cPos, err
+	}
+
 	pos := b.cPos
 	switch whence {
 	case io.SeekCurrent:
@@ -311,12 +456,15 @@ func (b *Body) Seek(offset int64, whence int) (int64, error) {
 	if pos == 0 {
 		b.seeked = false
 		b.md5.Reset()
+		if r, ok := b.digester.(interface{ Reset() }); ok {
+			r.Reset()
+		}
 	} else {
 		b.seeked = true
 	}
 
 	b.cPos = pos
-	if b.body != nil {
+	if !b.parallel && b.body != nil {
 		b.body.Close()
 		b.body = nil
 	}
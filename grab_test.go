@@ -2,7 +2,10 @@ package grab
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"hash"
 	"io"
@@ -10,6 +13,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -49,6 +53,34 @@ func (srv *MockServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(testContent))
 }
 
+// testFixedScheduler splits a resource into exactly n ranges, ignoring
+// minChunkSize, so a test can force genuine parallel chunking against
+// testContent without it collapsing back to a single range the way
+// NewFixedScheduler would for a fixture this small.
+type testFixedScheduler struct{ n int }
+
+func (s testFixedScheduler) Schedule(total int64) []ChunkRange {
+	n := s.n
+	if int64(n) > total {
+		n = int(total)
+	}
+	if n < 1 {
+		n = 1
+	}
+	size := total / int64(n)
+	ranges := make([]ChunkRange, n)
+	start := int64(0)
+	for i := 0; i < n; i++ {
+		end := start + size - 1
+		if i == n-1 {
+			end = total - 1
+		}
+		ranges[i] = ChunkRange{Start: start, End: end}
+		start = end + 1
+	}
+	return ranges
+}
+
 func TestGrab(t *testing.T) {
 	srv := httptest.NewServer(&MockServer{})
 	defer srv.Close()
@@ -104,6 +136,588 @@ func TestGrab(t *testing.T) {
 	}
 }
 
+func TestGrabParallel(t *testing.T) {
+	srv := httptest.NewServer(&MockServer{})
+	defer srv.Close()
+
+	g, err := OpenWith(srv.URL, WithChunks(4), WithScheduler(testFixedScheduler{n: 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if g.Len() != testContentLength {
+		t.Fatalf("wanted response length %d, got %d", testContentLength, g.Len())
+	}
+
+	compare := md5.New()
+	rd, err := io.Copy(compare, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd != testContentLength {
+		t.Fatalf("expected %d bytes read, got %d", testContentLength, rd)
+	}
+
+	expect := fmt.Sprintf("%x", testContentHash.Sum(nil))
+	got := fmt.Sprintf("%x", compare.Sum(nil))
+	if expect != got {
+		t.Fatalf("Expected MD5 hash of %q; got %q", expect, got)
+	}
+	if err := g.VerifyCopiedData(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range g.Chunks() {
+		if !c.Done || c.Err != nil {
+			t.Fatalf("chunk %+v did not complete cleanly", c)
+		}
+	}
+}
+
+func TestGrabParallelFallsBackWithoutRangeSupport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", testContentLength))
+		w.Write(testContent)
+	}))
+	defer srv.Close()
+
+	g, err := OpenWith(srv.URL, WithChunks(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if g.Chunks() != nil {
+		t.Fatal("expected download without range support to fall back to a single stream")
+	}
+
+	compare := md5.New()
+	if _, err := io.Copy(compare, g); err != nil {
+		t.Fatal(err)
+	}
+	expect := fmt.Sprintf("%x", testContentHash.Sum(nil))
+	got := fmt.Sprintf("%x", compare.Sum(nil))
+	if expect != got {
+		t.Fatalf("Expected MD5 hash of %q; got %q", expect, got)
+	}
+}
+
+func TestGrabParallelCloseUnblocksStalledChunk(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Range")
+		if rng == "" {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", testContentLength))
+			w.Write(testContent)
+			return
+		}
+
+		var start, end int64
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+			t.Errorf("unparseable Range header %q", rng)
+			return
+		}
+
+		// Chunk 0 is fetched synchronously to validate range support, so it
+		// must complete normally; every other chunk stalls forever after a
+		// few bytes, simulating a server that hangs mid-response.
+		if start == 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, testContentLength))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(testContent[start : end+1])
+			return
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, testContentLength))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(testContent[start : start+1])
+		w.(http.Flusher).Flush()
+		<-block
+	}))
+	defer srv.Close()
+
+	g, err := OpenWith(srv.URL, WithChunks(4), WithScheduler(testFixedScheduler{n: 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Chunks()) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(g.Chunks()))
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- g.Close() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error from Close: %s", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close did not return while a chunk request was stalled")
+	}
+}
+
+func TestGrabParallelRetriesTransientChunkError(t *testing.T) {
+	var mu sync.Mutex
+	failedOnce := make(map[int64]bool)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Range")
+		if rng == "" {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", testContentLength))
+			w.Write(testContent)
+			return
+		}
+
+		var start, end int64
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+			t.Errorf("unparseable Range header %q", rng)
+			return
+		}
+
+		// Every chunk but the first (fetched synchronously to validate range
+		// support) fails with a transient 503 on its first attempt, and must
+		// succeed on retry rather than permanently failing the download.
+		if start != 0 {
+			mu.Lock()
+			fail := !failedOnce[start]
+			failedOnce[start] = true
+			mu.Unlock()
+			if fail {
+				http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, testContentLength))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(testContent[start : end+1])
+	}))
+	defer srv.Close()
+
+	g, err := OpenWith(srv.URL, WithChunks(4), WithScheduler(testFixedScheduler{n: 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if len(g.Chunks()) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(g.Chunks()))
+	}
+
+	if _, err := io.Copy(ioutil.Discard, g); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.VerifyCopiedData(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range g.Chunks() {
+		if !c.Done || c.Err != nil {
+			t.Fatalf("chunk %+v did not complete successfully", c)
+		}
+		if c.Range.Start != 0 && c.Attempts < 2 {
+			t.Fatalf("chunk %+v: expected at least 2 attempts after a transient 503", c)
+		}
+	}
+}
+
+func TestGrabContextCancel(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", testContentLength))
+		w.WriteHeader(http.StatusOK)
+		w.Write(testContent[:testContentLength/2])
+		w.(http.Flusher).Flush()
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, err := OpenContext(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	buf := make([]byte, testContentLength/2)
+	if _, err := io.ReadFull(g, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, g)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read did not return after context cancellation")
+	}
+}
+
+func TestGrabMultipartETag(t *testing.T) {
+	part1 := bytes.Repeat([]byte{0x01}, 6<<20)
+	part2 := bytes.Repeat([]byte{0x02}, 2<<20)
+	content := append(append([]byte{}, part1...), part2...)
+
+	h1 := md5.Sum(part1)
+	h2 := md5.Sum(part2)
+	concat := append(append([]byte{}, h1[:]...), h2[:]...)
+	etag := fmt.Sprintf(`"%x-2"`, md5.Sum(concat))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("partNumber") == "1" {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(part1)))
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Accept-Ranges", "bytes")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	g, err := Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if _, err := io.Copy(ioutil.Discard, g); err != nil {
+		t.Fatal(err)
+	}
+	if g.VerifierName() != "s3-multipart" {
+		t.Fatalf("expected s3-multipart verifier to match, got %q", g.VerifierName())
+	}
+	if err := g.VerifyCopiedData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrabSHA256ChecksumHeader(t *testing.T) {
+	sum := sha256.Sum256(testContent)
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amz-checksum-sha256", digest)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testContent))
+	}))
+	defer srv.Close()
+
+	g, err := Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if _, err := io.Copy(ioutil.Discard, g); err != nil {
+		t.Fatal(err)
+	}
+	if g.VerifierName() != "sha256-checksum" {
+		t.Fatalf("expected sha256-checksum verifier to match, got %q", g.VerifierName())
+	}
+	if err := g.VerifyCopiedData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrabDigestHeader(t *testing.T) {
+	sum := sha256.Sum256(testContent)
+	digest := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Digest", digest)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testContent))
+	}))
+	defer srv.Close()
+
+	g, err := Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if _, err := io.Copy(ioutil.Discard, g); err != nil {
+		t.Fatal(err)
+	}
+	if g.VerifierName() != "digest" {
+		t.Fatalf("expected digest verifier to match, got %q", g.VerifierName())
+	}
+	if err := g.VerifyCopiedData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrabResume(t *testing.T) {
+	srv := httptest.NewServer(&MockServer{})
+	defer srv.Close()
+
+	g, err := Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	half := make([]byte, testContentLength/2)
+	if _, err := io.ReadFull(g, half); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved bytes.Buffer
+	if err := g.SaveState(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := Resume(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+
+	if resumed.Len() != testContentLength {
+		t.Fatalf("wanted resumed length %d, got %d", testContentLength, resumed.Len())
+	}
+
+	compare := md5.New()
+	compare.Write(half)
+	if _, err := io.Copy(compare, resumed); err != nil {
+		t.Fatal(err)
+	}
+	expect := fmt.Sprintf("%x", testContentHash.Sum(nil))
+	got := fmt.Sprintf("%x", compare.Sum(nil))
+	if expect != got {
+		t.Fatalf("Expected MD5 hash of %q; got %q", expect, got)
+	}
+	if err := resumed.VerifyCopiedData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrabResumeVerifiesMD5ETag(t *testing.T) {
+	etag := fmt.Sprintf("%x", testContentHash.Sum(nil))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testContent))
+	}))
+	defer srv.Close()
+
+	g, err := Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.VerifierName() != "md5" {
+		t.Fatalf("expected md5 verifier to match, got %q", g.VerifierName())
+	}
+
+	half := make([]byte, testContentLength/2)
+	if _, err := io.ReadFull(g, half); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved bytes.Buffer
+	if err := g.SaveState(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := Resume(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+
+	if resumed.VerifierName() != "md5" {
+		t.Fatalf("expected resumed download to keep matching the md5 verifier, got %q", resumed.VerifierName())
+	}
+	if _, err := io.Copy(ioutil.Discard, resumed); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.VerifyCopiedData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrabResumeDetectsChangedResource(t *testing.T) {
+	etag := `"original"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testContent))
+	}))
+	defer srv.Close()
+
+	g, err := Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := make([]byte, testContentLength/2)
+	if _, err := io.ReadFull(g, half); err != nil {
+		t.Fatal(err)
+	}
+	var saved bytes.Buffer
+	if err := g.SaveState(&saved); err != nil {
+		t.Fatal(err)
+	}
+	g.Close()
+
+	etag = `"changed"`
+	if _, err := Resume(&saved); err != ErrResourceChanged {
+		t.Fatalf("expected ErrResourceChanged, got %v", err)
+	}
+}
+
+func TestGrabProgress(t *testing.T) {
+	srv := httptest.NewServer(&MockServer{})
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var calls int
+	var lastRead, lastTotal int64
+	var lastErr error
+
+	g, err := OpenWith(srv.URL, WithProgress(func(read, total int64, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		lastRead, lastTotal, lastErr = read, total, err
+	}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if _, err := io.Copy(ioutil.Discard, g); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls == 0 {
+		t.Fatal("expected at least one progress callback")
+	}
+	if lastRead != testContentLength || lastTotal != testContentLength {
+		t.Fatalf("expected final progress call to report %d/%d, got %d/%d", testContentLength, testContentLength, lastRead, lastTotal)
+	}
+	if lastErr != nil {
+		t.Fatalf("expected final progress call to report a nil error, got %v", lastErr)
+	}
+	if g.BytesRead() != testContentLength {
+		t.Fatalf("expected BytesRead() == %d, got %d", testContentLength, g.BytesRead())
+	}
+}
+
+type stubRateLimiter struct {
+	mu    sync.Mutex
+	calls int
+	n     int
+}
+
+func (s *stubRateLimiter) WaitN(ctx context.Context, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	s.n += n
+	return nil
+}
+
+func TestGrabRateLimiter(t *testing.T) {
+	srv := httptest.NewServer(&MockServer{})
+	defer srv.Close()
+
+	rl := &stubRateLimiter{}
+	g, err := OpenWith(srv.URL, WithRateLimiter(rl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if _, err := io.Copy(ioutil.Discard, g); err != nil {
+		t.Fatal(err)
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.calls == 0 {
+		t.Fatal("expected WaitN to be called at least once")
+	}
+	if int64(rl.n) != testContentLength {
+		t.Fatalf("expected WaitN to see %d total bytes, got %d", testContentLength, rl.n)
+	}
+}
+
+func TestGrabRateLimiterAppliesToParallelIngress(t *testing.T) {
+	srv := httptest.NewServer(&MockServer{})
+	defer srv.Close()
+
+	rl := &stubRateLimiter{}
+	g, err := OpenWith(srv.URL, WithChunks(4), WithScheduler(testFixedScheduler{n: 4}), WithRateLimiter(rl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if len(g.Chunks()) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(g.Chunks()))
+	}
+
+	// Give the background chunk fetches time to land on disk without the
+	// test ever calling Read, to prove the limiter gates the download
+	// itself rather than only the caller's consumption of it.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		done := true
+		for _, c := range g.Chunks() {
+			if !c.Done {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("chunks did not finish downloading in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rl.mu.Lock()
+	calls, n := rl.calls, rl.n
+	rl.mu.Unlock()
+	if calls == 0 {
+		t.Fatal("expected WaitN to be called while chunks were downloading, before any Read")
+	}
+	if int64(n) != testContentLength {
+		t.Fatalf("expected WaitN to see %d total bytes, got %d", testContentLength, n)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, g); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.VerifyCopiedData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 type BrokenReadSeeker struct {
 	TotalLength int64
 
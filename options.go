@@ -0,0 +1,131 @@
+package grab
+
+import (
+	"net/http"
+	"time"
+)
+
+// options holds the resolved configuration for a download built up from a
+// series of Option values passed to OpenWith.
+type options struct {
+	n      int
+	c      *http.Client
+	header http.Header
+
+	chunks    int
+	scheduler Scheduler
+
+	verifiers []Verifier
+
+	rateLimiter   RateLimiter
+	progress      func(read, total int64, err error)
+	progressEvery time.Duration
+}
+
+func defaultOptions() *options {
+	return &options{
+		n:      DefaultAttempts,
+		c:      DefaultClient,
+		chunks: 1,
+	}
+}
+
+// Option configures a download started by OpenWith.
+type Option func(*options)
+
+// WithAttempts overrides the number of retry attempts used for every request
+// made during the download. A value <= 0 is ignored.
+func WithAttempts(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.n = n
+		}
+	}
+}
+
+// WithClient overrides the http.Client used to make requests. A nil value is
+// ignored, leaving DefaultClient in place.
+func WithClient(c *http.Client) Option {
+	return func(o *options) {
+		if c != nil {
+			o.c = c
+		}
+	}
+}
+
+// WithHeader sets the headers to copy onto the initial request and, via
+// CheckRedirectPreserveHeaders, any subsequent redirects.
+func WithHeader(h http.Header) Option {
+	return func(o *options) {
+		o.header = h
+	}
+}
+
+// WithChunks requests that the download be split into n concurrent ranged
+// requests instead of a single stream. It has no effect if the remote server
+// does not advertise support for range requests, or does not report a
+// Content-Length, in which case Open falls back to a single stream.
+func WithChunks(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.chunks = n
+		}
+	}
+}
+
+// WithScheduler overrides the Scheduler used to split the resource into
+// chunks when WithChunks requests more than one. It has no effect for
+// single-stream downloads.
+func WithScheduler(s Scheduler) Option {
+	return func(o *options) {
+		if s != nil {
+			o.scheduler = s
+		}
+	}
+}
+
+// WithVerifiers overrides DefaultVerifiers for this download, selecting the
+// first Verifier in vs whose Detect matches the response. Pass a single
+// Verifier to force a specific one.
+func WithVerifiers(vs ...Verifier) Option {
+	return func(o *options) {
+		o.verifiers = vs
+	}
+}
+
+// WithRateLimiter caps the rate bytes are pulled off the wire at rl. For a
+// single-stream download that's consulted directly from Read; for a
+// WithChunks(n) parallel download it's consulted independently by each
+// chunk's background fetch, so rl should tolerate concurrent WaitN calls
+// (as *golang.org/x/time/rate.Limiter does) — the combined ingress across
+// every chunk is what's capped, not each chunk individually.
+func WithRateLimiter(rl RateLimiter) Option {
+	return func(o *options) {
+		o.rateLimiter = rl
+	}
+}
+
+// WithProgress registers fn to be called as the download progresses, with
+// the number of bytes read so far, the total size (or <= 0 if unknown),
+// and a non-nil err only on the final call if the download failed. Calls
+// are throttled to at most once per interval; a zero interval reports on
+// every Read. fn is only called from within Body.Read, on the goroutine
+// calling Read, for single-stream and parallel downloads alike; the
+// background chunk fetches never call it. For a parallel download,
+// progress tracks what the caller has read back out of Body, which can
+// lag behind how much has actually landed on disk; see Body.Chunks for
+// the state of each chunk's own download.
+func WithProgress(fn func(read, total int64, err error), interval time.Duration) Option {
+	return func(o *options) {
+		o.progress = fn
+		o.progressEvery = interval
+	}
+}
+
+func (o *options) apply(opts []Option) {
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+}
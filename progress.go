@@ -0,0 +1,117 @@
+package grab
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter caps the rate bytes are read from a Body. It's satisfied by
+// *golang.org/x/time/rate.Limiter, or any other type exposing a compatible
+// WaitN; grab doesn't depend on the rate package directly.
+type RateLimiter interface {
+	WaitN(ctx context.Context, n int) error
+}
+
+// rateSampleWindow is the minimum duration over which an instantaneous
+// transfer rate is sampled before it's folded into the EWMA returned by
+// Body.Rate.
+const rateSampleWindow = 200 * time.Millisecond
+
+// rateSmoothing weights each new rate sample against the running average;
+// closer to 1 reacts faster to bursts, closer to 0 smooths harder.
+const rateSmoothing = 0.3
+
+// trackRead records n freshly read bytes against b's BytesRead/Rate
+// counters, waits on b.rateLimiter if one is set, and reports progress.
+// It must only be called with bytes that came from the network exactly
+// once, so retried reads are never double-counted.
+//
+// For a sequential download this is the only place bytes ever pass
+// through, so it's both the ingress and the consumption point. Parallel
+// downloads are different: the network read happens earlier, in
+// fetchChunkOnce, so that's where rate limiting has to apply (see
+// waitRateLimit); readParallel only calls recordRead, to avoid waiting on
+// the limiter twice for the same bytes.
+func (b *Body) trackRead(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	b.recordRead(n)
+	return b.waitRateLimit(b.ctx, n)
+}
+
+// recordRead updates b's BytesRead/Rate counters and reports progress for n
+// freshly read bytes, without consulting b.rateLimiter.
+func (b *Body) recordRead(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&b.bytesRead, int64(n))
+	b.sampleRate(n)
+	b.reportProgress(nil, false)
+}
+
+// waitRateLimit blocks until b.rateLimiter, if set, admits n bytes. ctx is
+// taken explicitly rather than always using b.ctx so fetchChunkOnce can
+// gate on b.chunkCtx, which Close always cancels promptly.
+func (b *Body) waitRateLimit(ctx context.Context, n int) error {
+	if b.rateLimiter == nil || n <= 0 {
+		return nil
+	}
+	return b.rateLimiter.WaitN(ctx, n)
+}
+
+func (b *Body) sampleRate(n int) {
+	b.rateMu.Lock()
+	defer b.rateMu.Unlock()
+
+	now := time.Now()
+	if b.rateSampledAt.IsZero() {
+		b.rateSampledAt = now
+	}
+	b.rateSampleBytes += int64(n)
+
+	elapsed := now.Sub(b.rateSampledAt)
+	if elapsed < rateSampleWindow {
+		return
+	}
+	instant := float64(b.rateSampleBytes) / elapsed.Seconds()
+	if b.rate == 0 {
+		b.rate = instant
+	} else {
+		b.rate = rateSmoothing*instant + (1-rateSmoothing)*b.rate
+	}
+	b.rateSampledAt = now
+	b.rateSampleBytes = 0
+}
+
+// reportProgress invokes b.progress, if set, with the total bytes read so
+// far and err. Calls are throttled to b.progressEvery unless force is true.
+func (b *Body) reportProgress(err error, force bool) {
+	if b.progress == nil {
+		return
+	}
+	now := time.Now()
+	if !force && now.Sub(b.progressAt) < b.progressEvery {
+		return
+	}
+	b.progressAt = now
+	b.progress(atomic.LoadInt64(&b.bytesRead), b.tPos, err)
+}
+
+// BytesRead returns the total number of bytes read out of b so far. For a
+// parallel download this counts what the caller has read back out of b,
+// which can lag behind how much the chunk fetches have downloaded.
+func (b *Body) BytesRead() int64 {
+	return atomic.LoadInt64(&b.bytesRead)
+}
+
+// Rate returns the current transfer rate in bytes per second, smoothed
+// with an exponentially weighted moving average. It reads 0 until the
+// first rateSampleWindow of data has been read.
+func (b *Body) Rate() float64 {
+	b.rateMu.Lock()
+	defer b.rateMu.Unlock()
+	return b.rate
+}
@@ -0,0 +1,197 @@
+package grab
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrResourceChanged is returned by Resume and ResumeContext when the
+// remote resource no longer matches the ETag or Last-Modified value
+// recorded in the saved state, meaning it isn't safe to continue the
+// download from the saved position.
+var ErrResourceChanged = errors.New("grab: resource has changed since state was saved")
+
+// state is the on-disk representation of a Body written by SaveState and
+// read back by Resume.
+type state struct {
+	URL          string      `json:"url"`
+	EffectiveURL string      `json:"effective_url"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Length       int64       `json:"length"`
+	Pos          int64       `json:"pos"`
+	MD5          []byte      `json:"md5"`
+	Header       http.Header `json:"header,omitempty"`
+}
+
+// SaveState serializes enough of b's progress to w that Resume can
+// continue the download later, potentially in a different process. It is
+// only supported for a single-stream download that hasn't been seeked.
+func (b *Body) SaveState(w io.Writer) error {
+	if b.parallel {
+		return errors.New("grab: cannot save state for a parallel download")
+	}
+	if b.seeked {
+		return errors.New("grab: cannot save state for a body that has been seeked")
+	}
+
+	marshaler, ok := b.md5.(encoding.BinaryMarshaler)
+	if !ok {
+		return errors.Errorf("grab: %T does not support saving its state", b.md5)
+	}
+	md5State, err := marshaler.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	s := state{
+		URL:          b.origURL,
+		EffectiveURL: b.req.URL.String(),
+		LastModified: b.lastModified,
+		Length:       b.tPos,
+		Pos:          b.cPos,
+		MD5:          md5State,
+		Header:       b.req.Header,
+	}
+	if b.ETag != nil {
+		s.ETag = *b.ETag
+	}
+
+	return json.NewEncoder(w).Encode(&s)
+}
+
+// Resume continues a download previously saved with Body.SaveState.
+func Resume(r io.Reader, opts ...Option) (*Body, error) {
+	return ResumeContext(context.Background(), r, opts...)
+}
+
+// ResumeContext is Resume with an added context; see OpenWithContext.
+//
+// ResumeContext re-issues the request with a Range: bytes=cPos- header and
+// requires the server's current ETag and Last-Modified to still match the
+// saved state, returning ErrResourceChanged otherwise. On success, bytes
+// read from the returned Body continue to accumulate into the same MD5
+// state captured at save time, so VerifyCopiedData still works once the
+// download completes.
+func ResumeContext(ctx context.Context, r io.Reader, opts ...Option) (*Body, error) {
+	var s state
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+
+	o := defaultOptions()
+	o.apply(opts)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.EffectiveURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+
+	resp, err := retry(req, o.c, o.n, &s.Pos)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.ETag != "" {
+		if etag := parseETag(resp); etag == nil || *etag != s.ETag {
+			resp.Body.Close()
+			return nil, ErrResourceChanged
+		}
+	}
+	if s.LastModified != "" && resp.Header.Get("Last-Modified") != s.LastModified {
+		resp.Body.Close()
+		return nil, ErrResourceChanged
+	}
+	if total, ok := contentRangeTotal(resp.Header.Get("Content-Range")); ok && total != s.Length {
+		resp.Body.Close()
+		return nil, ErrResourceChanged
+	}
+
+	md5sum := md5.New()
+	if unmarshaler, ok := interface{}(md5sum).(encoding.BinaryUnmarshaler); ok {
+		if err := unmarshaler.UnmarshalBinary(s.MD5); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	// Re-run the live response past the same verifiers OpenWithContext
+	// would, so a resumed download keeps verifying just like a fresh one.
+	// Only MD5Verifier's digest can have its state restored here, by
+	// unmarshalling the same saved MD5 state into its hash that was
+	// unmarshalled into md5sum above. The others would start from scratch
+	// and see only the bytes read after resume, so they would compare
+	// against the wrong digest. Those are dropped rather than left to fail
+	// VerifyCopiedData spuriously.
+	verifiers := o.verifiers
+	if verifiers == nil {
+		verifiers = DefaultVerifiers
+	}
+	digester, verifierName := detectVerifier(resp, req, o.c, verifiers)
+	digestWriter := io.Writer(md5sum)
+	if digester != nil {
+		if hd, ok := digester.(*hashDigester); ok && verifierName == (MD5Verifier{}).Name() {
+			if unmarshaler, ok := interface{}(hd.h).(encoding.BinaryUnmarshaler); ok {
+				if err := unmarshaler.UnmarshalBinary(s.MD5); err != nil {
+					resp.Body.Close()
+					return nil, err
+				}
+				digestWriter = io.MultiWriter(md5sum, digester)
+			} else {
+				digester, verifierName = nil, ""
+			}
+		} else {
+			Log.Printf("resume: cannot restore %s verifier state across a resume, skipping verification", verifierName)
+			digester, verifierName = nil, ""
+		}
+	}
+	tee := io.TeeReader(resp.Body, digestWriter)
+
+	var etag *string
+	if s.ETag != "" {
+		etag = &s.ETag
+	}
+
+	return &Body{
+		ETag:         etag,
+		md5:          md5sum,
+		digester:     digester,
+		digestWriter: digestWriter,
+		verifierName: verifierName,
+		tee:          tee,
+		c:            o.c,
+		body:         resp.Body,
+		cPos:         s.Pos,
+		tPos:         s.Length,
+		req:          req,
+		n:            o.n,
+		ctx:          ctx,
+		origURL:      s.URL,
+		lastModified: s.LastModified,
+	}, nil
+}
+
+// contentRangeTotal parses the total size out of a Content-Range header of
+// the form "bytes start-end/total".
+func contentRangeTotal(h string) (int64, bool) {
+	idx := strings.LastIndex(h, "/")
+	if idx < 0 {
+		return 0, false
+	}
+	var total int64
+	if _, err := fmt.Sscanf(h[idx+1:], "%d", &total); err != nil {
+		return 0, false
+	}
+	return total, true
+}
@@ -0,0 +1,293 @@
+package grab
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Digester accumulates the bytes of a download as they're read and, once the
+// transfer is complete, checks the result against whatever expectation its
+// Verifier captured when the download began.
+type Digester interface {
+	io.Writer
+	Verify() error
+}
+
+// Verifier inspects the headers of a response and, if it recognises an
+// expected digest there, returns a Digester to check the transfer against
+// it. DefaultVerifiers is tried in order until one matches; register
+// additional implementations with RegisterVerifier.
+type Verifier interface {
+	// Name identifies the verifier, surfaced via Body.VerifierName after a
+	// successful match.
+	Name() string
+
+	// Detect reports whether this verifier applies to resp, returning a
+	// Digester to accumulate the body into if so. req and c are the
+	// request and client used for the download, for verifiers (such as the
+	// S3 multipart one) that need to make an additional request to learn
+	// how to check the transfer.
+	Detect(resp *http.Response, req *http.Request, c *http.Client) (Digester, bool)
+}
+
+// DefaultVerifiers is the list of Verifiers tried, in order, by Open and
+// OpenWith. Append to it with RegisterVerifier to support additional digest
+// formats globally.
+var DefaultVerifiers = []Verifier{
+	MD5Verifier{},
+	S3MultipartVerifier{},
+	SHA256ChecksumVerifier{},
+	DigestHeaderVerifier{},
+}
+
+// RegisterVerifier appends v to DefaultVerifiers.
+func RegisterVerifier(v Verifier) {
+	DefaultVerifiers = append(DefaultVerifiers, v)
+}
+
+// detectVerifier runs resp past every verifier in vs, in order, returning
+// the Digester and name of the first one that matches.
+func detectVerifier(resp *http.Response, req *http.Request, c *http.Client, vs []Verifier) (Digester, string) {
+	for _, v := range vs {
+		if d, ok := v.Detect(resp, req, c); ok {
+			return d, v.Name()
+		}
+	}
+	return nil, ""
+}
+
+// parseETag returns the value of the response's ETag header with any
+// surrounding quotes and weak-validator prefix removed, or nil if the
+// header is absent.
+func parseETag(resp *http.Response) *string {
+	v := resp.Header.Get("Etag")
+	if v == "" {
+		return nil
+	}
+	v = strings.TrimPrefix(v, "W/")
+	v = strings.Trim(v, `"`)
+	if v == "" {
+		return nil
+	}
+	return &v
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// hashDigester is a Digester backed by a single hash.Hash, comparing its
+// encoded sum against an expectation captured at detection time.
+type hashDigester struct {
+	h      hash.Hash
+	label  string
+	expect string
+	encode func([]byte) string
+}
+
+func (d *hashDigester) Write(p []byte) (int, error) {
+	return d.h.Write(p)
+}
+
+func (d *hashDigester) Reset() {
+	d.h.Reset()
+}
+
+func (d *hashDigester) Verify() error {
+	got := d.encode(d.h.Sum(nil))
+	if got != d.expect {
+		return errors.Errorf("%s: server reported digest of %q but we calculated %q", d.label, d.expect, got)
+	}
+	return nil
+}
+
+func hexEncode(b []byte) string {
+	return fmt.Sprintf("%x", b)
+}
+
+// MD5Verifier matches a plain, single-part ETag: a bare 32 character MD5
+// hex digest with no multipart suffix.
+type MD5Verifier struct{}
+
+func (MD5Verifier) Name() string { return "md5" }
+
+func (MD5Verifier) Detect(resp *http.Response, _ *http.Request, _ *http.Client) (Digester, bool) {
+	tag := parseETag(resp)
+	if tag == nil || !isHex(*tag, 32) {
+		return nil, false
+	}
+	return &hashDigester{h: md5.New(), label: "MD5", expect: strings.ToLower(*tag), encode: hexEncode}, true
+}
+
+// SHA256ChecksumVerifier matches the base64 sha256 checksum S3 reports on
+// objects uploaded with the x-amz-checksum-sha256 trailer.
+type SHA256ChecksumVerifier struct{}
+
+func (SHA256ChecksumVerifier) Name() string { return "sha256-checksum" }
+
+func (SHA256ChecksumVerifier) Detect(resp *http.Response, _ *http.Request, _ *http.Client) (Digester, bool) {
+	v := resp.Header.Get("x-amz-checksum-sha256")
+	if v == "" {
+		return nil, false
+	}
+	return &hashDigester{h: sha256.New(), label: "SHA-256", expect: v, encode: base64.StdEncoding.EncodeToString}, true
+}
+
+// DigestHeaderVerifier matches the RFC 3230 Digest header, e.g.
+// "Digest: sha-256=<base64>". Only the sha-256 algorithm is supported.
+type DigestHeaderVerifier struct{}
+
+func (DigestHeaderVerifier) Name() string { return "digest" }
+
+func (DigestHeaderVerifier) Detect(resp *http.Response, _ *http.Request, _ *http.Client) (Digester, bool) {
+	header := resp.Header.Get("Digest")
+	if header == "" {
+		return nil, false
+	}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if !strings.EqualFold(kv[0], "sha-256") {
+			continue
+		}
+		return &hashDigester{h: sha256.New(), label: "SHA-256", expect: kv[1], encode: base64.StdEncoding.EncodeToString}, true
+	}
+	return nil, false
+}
+
+// S3MultipartVerifier matches an ETag produced by an S3 multipart upload:
+// "<md5-of-part-md5s>-<part-count>". It probes the object with
+// ?partNumber=1 to learn the upload's part size, then recomputes the
+// ETag by hashing each part of the reassembled stream as it arrives.
+type S3MultipartVerifier struct{}
+
+func (S3MultipartVerifier) Name() string { return "s3-multipart" }
+
+func (S3MultipartVerifier) Detect(resp *http.Response, req *http.Request, c *http.Client) (Digester, bool) {
+	tag := parseETag(resp)
+	if tag == nil {
+		return nil, false
+	}
+	idx := strings.LastIndex(*tag, "-")
+	if idx <= 0 || !isHex((*tag)[:idx], 32) {
+		return nil, false
+	}
+	partCount, err := strconv.Atoi((*tag)[idx+1:])
+	if err != nil || partCount < 1 {
+		return nil, false
+	}
+
+	partSize, err := probePartSize(req, c)
+	if err != nil {
+		Log.Printf("s3-multipart: could not probe part size, skipping verification: %s", err)
+		return nil, false
+	}
+
+	return &s3MultipartDigester{partSize: partSize, expect: strings.ToLower(*tag)}, true
+}
+
+// probePartSize issues a HEAD ?partNumber=1 request to learn the size of
+// the first part of a multipart upload.
+func probePartSize(req *http.Request, c *http.Client) (int64, error) {
+	u := *req.URL
+	q := u.Query()
+	q.Set("partNumber", "1")
+	u.RawQuery = q.Encode()
+
+	probe := req.Clone(req.Context())
+	probe.Method = http.MethodHead
+	probe.URL = &u
+	probe.Body = nil
+	probe.ContentLength = 0
+
+	resp, err := c.Do(probe)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return 0, errors.Errorf("probe request returned status %d", resp.StatusCode)
+	}
+	if resp.ContentLength <= 0 {
+		return 0, errors.New("probe response is missing Content-Length")
+	}
+	return resp.ContentLength, nil
+}
+
+// s3MultipartDigester hashes the reassembled stream one partSize-sized part
+// at a time, reproducing the way S3 computes a multipart ETag: the hex MD5
+// of the concatenation of each part's own MD5 digest.
+type s3MultipartDigester struct {
+	partSize int64
+
+	expect string
+
+	cur      hash.Hash
+	inPart   int64
+	partSums []byte
+}
+
+func (d *s3MultipartDigester) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if d.cur == nil {
+			d.cur = md5.New()
+			d.inPart = 0
+		}
+		room := d.partSize - d.inPart
+		chunk := p
+		if int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := d.cur.Write(chunk)
+		written += n
+		d.inPart += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if d.inPart == d.partSize {
+			d.partSums = append(d.partSums, d.cur.Sum(nil)...)
+			d.cur = nil
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (d *s3MultipartDigester) Reset() {
+	d.cur = nil
+	d.inPart = 0
+	d.partSums = nil
+}
+
+func (d *s3MultipartDigester) Verify() error {
+	partSums := d.partSums
+	if d.cur != nil {
+		partSums = append(partSums, d.cur.Sum(nil)...)
+	}
+	got := fmt.Sprintf("%x-%d", md5.Sum(partSums), len(partSums)/md5.Size)
+	if got != d.expect {
+		return errors.Errorf("S3 multipart: server reported ETag of %q but we calculated %q", d.expect, got)
+	}
+	return nil
+}